@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package rapid
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FailureDB persists minimized failing test cases keyed by test name.
+// shrink saves the minimized counterexample to FailureDB on failure; Load
+// and Delete are exposed for a caller to replay or discard a recorded
+// failure itself, since this package does not yet call Load on its own.
+//
+// Implementations must be safe for concurrent use.
+type FailureDB interface {
+	// Load returns the recorded buffer for testName and the fingerprint
+	// it was saved with, if any. ok is false if nothing is recorded.
+	Load(testName string) (data []uint64, fingerprint string, ok bool)
+	// Save records data as the minimized failing input for testName,
+	// together with fingerprint, overwriting any previous entry.
+	Save(testName string, data []uint64, fingerprint string) error
+	// Delete removes the recorded entry for testName, if any.
+	Delete(testName string) error
+}
+
+// dirFailureDB is the default FailureDB, storing one file per test name
+// under a directory.
+type dirFailureDB struct {
+	dir string
+}
+
+// NewDirFailureDB returns a FailureDB that stores failures as files under
+// filepath.Join(dir, testName).
+func NewDirFailureDB(dir string) FailureDB {
+	return &dirFailureDB{dir: dir}
+}
+
+func (db *dirFailureDB) path(testName string) string {
+	return filepath.Join(db.dir, testName)
+}
+
+func (db *dirFailureDB) Load(testName string) ([]uint64, string, bool) {
+	b, err := os.ReadFile(db.path(testName))
+	if err != nil {
+		return nil, "", false
+	}
+
+	fingerprint, data, ok := decodeFailure(b)
+	if !ok {
+		return nil, "", false
+	}
+
+	return data, fingerprint, true
+}
+
+func (db *dirFailureDB) Save(testName string, data []uint64, fingerprint string) error {
+	path := db.path(testName)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create failure db directory for %q: %w", testName, err)
+	}
+
+	return os.WriteFile(path, encodeFailure(fingerprint, data), 0o644)
+}
+
+func (db *dirFailureDB) Delete(testName string) error {
+	err := os.Remove(db.path(testName))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// encodeFailure lays out a length-prefixed fingerprint followed by the
+// buffer, big-endian.
+func encodeFailure(fingerprint string, data []uint64) []byte {
+	out := make([]byte, 4, 4+len(fingerprint)+8*len(data))
+	binary.BigEndian.PutUint32(out, uint32(len(fingerprint)))
+	out = append(out, fingerprint...)
+
+	for _, u := range data {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], u)
+		out = append(out, b[:]...)
+	}
+
+	return out
+}
+
+func decodeFailure(b []byte) (fingerprint string, data []uint64, ok bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+
+	n := int(binary.BigEndian.Uint32(b))
+	b = b[4:]
+	if len(b) < n {
+		return "", nil, false
+	}
+	fingerprint, b = string(b[:n]), b[n:]
+
+	if len(b)%8 != 0 {
+		return "", nil, false
+	}
+	data = make([]uint64, len(b)/8)
+	for i := range data {
+		data[i] = binary.BigEndian.Uint64(b[i*8 : i*8+8])
+	}
+
+	return fingerprint, data, true
+}
@@ -0,0 +1,101 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package rapid
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecodeFailureRoundTrip(t *testing.T) {
+	cases := []struct {
+		fingerprint string
+		data        []uint64
+	}{
+		{"", nil},
+		{"panic: boom", []uint64{1, 2, 3}},
+		{"multi\nline", []uint64{0, ^uint64(0)}},
+	}
+
+	for _, c := range cases {
+		b := encodeFailure(c.fingerprint, c.data)
+		fingerprint, data, ok := decodeFailure(b)
+		if !ok {
+			t.Fatalf("decodeFailure(%q) failed", b)
+		}
+		if fingerprint != c.fingerprint {
+			t.Fatalf("got fingerprint %q, want %q", fingerprint, c.fingerprint)
+		}
+		if !reflect.DeepEqual(data, c.data) && !(len(data) == 0 && len(c.data) == 0) {
+			t.Fatalf("got data %v, want %v", data, c.data)
+		}
+	}
+}
+
+func TestDecodeFailureTruncated(t *testing.T) {
+	b := encodeFailure("fingerprint", []uint64{1, 2})
+
+	// Truncated before the length prefix is complete, or mid-fingerprint:
+	// always invalid, regardless of what bytes happen to follow.
+	for n := 0; n < 4+len("fingerprint"); n++ {
+		if _, _, ok := decodeFailure(b[:n]); ok {
+			t.Fatalf("decodeFailure unexpectedly succeeded on truncated input of length %v", n)
+		}
+	}
+
+	// Truncated mid-uint64: the fingerprint is intact, but the data tail
+	// isn't a multiple of 8 bytes.
+	if _, _, ok := decodeFailure(b[:len(b)-1]); ok {
+		t.Fatalf("decodeFailure unexpectedly succeeded on input truncated by one byte")
+	}
+}
+
+func TestDirFailureDBSaveLoadDelete(t *testing.T) {
+	db := NewDirFailureDB(t.TempDir())
+
+	if _, _, ok := db.Load("TestFoo"); ok {
+		t.Fatalf("Load found an entry before any Save")
+	}
+
+	data := []uint64{1, 2, 3}
+	if err := db.Save("TestFoo", data, "fp1"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	gotData, gotFingerprint, ok := db.Load("TestFoo")
+	if !ok {
+		t.Fatalf("Load found nothing after Save")
+	}
+	if !reflect.DeepEqual(gotData, data) || gotFingerprint != "fp1" {
+		t.Fatalf("got (%v, %q), want (%v, %q)", gotData, gotFingerprint, data, "fp1")
+	}
+
+	if err := db.Delete("TestFoo"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, ok := db.Load("TestFoo"); ok {
+		t.Fatalf("Load found an entry after Delete")
+	}
+
+	// Delete of a missing entry is not an error.
+	if err := db.Delete("TestFoo"); err != nil {
+		t.Fatalf("Delete of missing entry: %v", err)
+	}
+}
+
+func TestDirFailureDBSaveNestedTestName(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDirFailureDB(dir)
+
+	testName := filepath.Join("TestFoo", "case1")
+	if err := db.Save(testName, []uint64{1}, "fp"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	if _, _, ok := db.Load(testName); !ok {
+		t.Fatalf("Load found nothing for subtest name %q", testName)
+	}
+}
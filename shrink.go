@@ -5,26 +5,77 @@
 package rapid
 
 import (
+	"context"
 	"fmt"
 	"math/bits"
 	"os"
+	"sync"
 	"time"
 )
 
-const shrinkTimeLimit = 30 * time.Second
+// ShrinkConfig controls the shrink termination policy and its observability.
+type ShrinkConfig struct {
+	// Deadline bounds the wall-clock time spent shrinking. Zero means
+	// DefaultShrinkConfig.Deadline.
+	Deadline time.Duration
+	// MaxTries bounds the number of candidate buffers tried. Zero means
+	// no limit.
+	MaxTries int
+	// MaxStallRounds stops shrinking after this many consecutive rounds
+	// with no improvement. Zero means stop after one.
+	MaxStallRounds int
+	// OnShrinkStep, if set, is called after every round with the
+	// counterexample buffer before and after, and the tries so far.
+	OnShrinkStep func(before, after []uint64, tries int)
+	// FailureDB, if set, receives the minimized counterexample on failure,
+	// keyed by test name.
+	FailureDB FailureDB
+	// Parallelism bounds how many candidate buffers are tried against prop
+	// concurrently. Zero means 1 (no concurrency). Set Parallelism > 1 to
+	// opt in; prop must be safe to call concurrently in that case.
+	Parallelism int
+}
+
+// DefaultShrinkConfig supplies the Deadline used when a zero Deadline is
+// supplied to shrink; its other fields are not consulted.
+var DefaultShrinkConfig = ShrinkConfig{
+	Deadline: 30 * time.Second,
+}
+
+// withDefaults fills in the zero-valued fields of config with their
+// effective defaults.
+func (config ShrinkConfig) withDefaults() ShrinkConfig {
+	if config.Deadline == 0 {
+		config.Deadline = DefaultShrinkConfig.Deadline
+	}
+	if config.Parallelism == 0 {
+		config.Parallelism = 1
+	}
+	return config
+}
 
-func shrink(tb limitedTB, rec recordedBits, err *panicError, prop func(*T)) ([]uint64, *panicError) {
+func shrink(tb limitedTB, rec recordedBits, err *panicError, prop func(*T), config ShrinkConfig) ([]uint64, *panicError) {
 	rec.prune()
 
+	config = config.withDefaults()
+
 	s := &shrinker{
-		tb:   tb,
-		rec:  rec,
-		err:  err,
-		prop: prop,
+		tb:     tb,
+		rec:    rec,
+		err:    err,
+		prop:   prop,
+		config: config,
+		ctx:    context.Background(),
 	}
 
 	buf, err := s.shrink()
 
+	if config.FailureDB != nil {
+		if saveErr := config.FailureDB.Save(tb.Name(), buf, traceback(err)); saveErr != nil {
+			tb.Logf("failed to save failure to FailureDB: %v", saveErr)
+		}
+	}
+
 	if *debugvis {
 		name := fmt.Sprintf("vis-%v.html", tb.Name())
 		f, err := os.Create(name)
@@ -47,8 +98,13 @@ type shrinker struct {
 	rec     recordedBits
 	err     *panicError
 	prop    func(*T)
+	config  ShrinkConfig
+	ctx     context.Context
+	start   time.Time
 	visBits []recordedBits
+	mu      sync.Mutex // guards tries against concurrent acceptBest workers
 	tries   int
+	stalled int
 }
 
 func (s *shrinker) debugf(format string, args ...interface{}) {
@@ -58,6 +114,46 @@ func (s *shrinker) debugf(format string, args ...interface{}) {
 	}
 }
 
+// budgetExceeded reports whether the configured termination policy says
+// shrinking should stop. It is checked both between rounds and inside the
+// passes that make up a round, so a single round cannot run past the
+// configured Deadline/MaxTries; a prop run already in progress when the
+// Deadline passes is not interrupted.
+func (s *shrinker) budgetExceeded() bool {
+	if s.config.Deadline > 0 && time.Since(s.start) >= s.config.Deadline {
+		s.debugf("shrink deadline of %v exceeded", s.config.Deadline)
+		return true
+	}
+	s.mu.Lock()
+	tries := s.tries
+	s.mu.Unlock()
+	if s.config.MaxTries > 0 && tries >= s.config.MaxTries {
+		s.debugf("shrink max tries of %v exceeded", s.config.MaxTries)
+		return true
+	}
+	return false
+}
+
+// roundDidNotImprove records a round that failed to shrink the
+// counterexample and reports whether ShrinkConfig.MaxStallRounds says to
+// stop now.
+func (s *shrinker) roundDidNotImprove() bool {
+	s.stalled++
+	maxStalled := s.config.MaxStallRounds
+	if maxStalled == 0 {
+		maxStalled = 1
+	}
+	return s.stalled >= maxStalled
+}
+
+// reportStep invokes ShrinkConfig.OnShrinkStep, if set, with the
+// counterexample before and after the current round.
+func (s *shrinker) reportStep(before []uint64) {
+	if s.config.OnShrinkStep != nil {
+		s.config.OnShrinkStep(before, s.rec.data, s.tries)
+	}
+}
+
 func (s *shrinker) shrink() (buf []uint64, err *panicError) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -65,48 +161,147 @@ func (s *shrinker) shrink() (buf []uint64, err *panicError) {
 		}
 	}()
 
+	s.start = time.Now()
+
 	i := 0
-	shrunk := true
-	start := time.Now()
-	for ; shrunk && time.Since(start) < shrinkTimeLimit; i++ {
-		data := append([]uint64(nil), s.rec.data...)
+	for !s.budgetExceeded() {
+		before := append([]uint64(nil), s.rec.data...)
 
 		s.debugf("round %v start", i)
 		s.removeBlockGroups()
 		s.minimizeBlocks()
+		s.collapseDuplicateGroups()
+		s.swapAdjacentGroups()
+
+		shrunk := compareData(s.rec.data, before) < 0
+		s.reportStep(before)
 
-		shrunk = compareData(s.rec.data, data) < 0
+		if shrunk {
+			s.stalled = 0
+		} else if s.roundDidNotImprove() {
+			s.debugf("stopping after %v round(s) with no improvement", s.stalled)
+			break
+		}
+		i++
 	}
 	s.debugf("done, %v rounds total (%v tries)", i, s.tries)
 
 	return s.rec.data, s.err
 }
 
+// removeBlockGroups repeatedly tries removing every currently removable
+// group, adopting the smallest of the removals confirmed to reproduce the
+// failure before the remaining candidates are canceled.
 func (s *shrinker) removeBlockGroups() {
-	for i := 0; i < len(s.rec.groups); {
-		g := s.rec.groups[i]
-		if !g.removable {
-			s.debugf("skip non-removable group %q at %v: [%v, %v)", g.label, i, g.begin, g.end)
-			i++
-			continue
+	for !s.budgetExceeded() {
+		var candidates [][]uint64
+		var labels []string
+
+		for i, g := range s.rec.groups {
+			if !g.removable {
+				s.debugf("skip non-removable group %q at %v: [%v, %v)", g.label, i, g.begin, g.end)
+				continue
+			}
+
+			buf := append([]uint64(nil), s.rec.data...)
+			if g.end >= 0 {
+				buf = append(buf[:g.begin], buf[g.end:]...)
+			} else {
+				buf = buf[:g.begin]
+			}
+			candidates = append(candidates, buf)
+			labels = append(labels, fmt.Sprintf("remove group %q at %v: [%v, %v)", g.label, i, g.begin, g.end))
 		}
 
-		buf := append([]uint64(nil), s.rec.data...)
-		if g.end >= 0 {
-			buf = append(buf[:g.begin], buf[g.end:]...)
-		} else {
-			buf = buf[:g.begin]
+		if len(candidates) == 0 || !s.acceptBest(candidates, labels) {
+			return
+		}
+	}
+}
+
+// collapseDuplicateGroups looks for pairs of removable, same-label groups
+// of equal length and tries overwriting the contents of one with the
+// contents of the other, in both directions.
+func (s *shrinker) collapseDuplicateGroups() {
+	restart := true
+	for restart && !s.budgetExceeded() {
+		restart = false
+
+		for i := 0; i < len(s.rec.groups) && !restart; i++ {
+			gi := s.rec.groups[i]
+			if !gi.removable || gi.end < 0 {
+				continue
+			}
+
+			for j := i + 1; j < len(s.rec.groups) && !restart; j++ {
+				gj := s.rec.groups[j]
+				if !gj.removable || gj.end < 0 || gj.label != gi.label {
+					continue
+				}
+				if gj.end-gj.begin != gi.end-gi.begin {
+					continue
+				}
+
+				buf := collapseCandidate(s.rec.data, gi, gj)
+				if s.accept(buf, "collapse group %q at %v into group at %v", gi.label, i, j) {
+					restart = true
+					break
+				}
+
+				buf = collapseCandidate(s.rec.data, gj, gi)
+				if s.accept(buf, "collapse group %q at %v into group at %v", gj.label, j, i) {
+					restart = true
+					break
+				}
+			}
 		}
-		if !s.accept(buf, "remove group %q at %v: [%v, %v)", g.label, i, g.begin, g.end) {
-			for i++; i < len(s.rec.groups) && s.rec.groups[i].begin == g.begin && s.rec.groups[i].end == g.end; i++ {
-				s.debugf("skip duplicate group %v: [%v, %v)", i, g.begin, g.end)
+	}
+}
+
+// collapseCandidate returns a copy of data with the contents of dst
+// overwritten by the contents of src.
+func collapseCandidate(data []uint64, src, dst group) []uint64 {
+	buf := append([]uint64(nil), data...)
+	copy(buf[dst.begin:dst.end], data[src.begin:src.end])
+	return buf
+}
+
+// swapAdjacentGroups tries reordering every pair of neighboring removable,
+// same-label groups.
+func (s *shrinker) swapAdjacentGroups() {
+	restart := true
+	for restart && !s.budgetExceeded() {
+		restart = false
+
+		for i := 0; i+1 < len(s.rec.groups); i++ {
+			gi, gj := s.rec.groups[i], s.rec.groups[i+1]
+			if !gi.removable || !gj.removable || gi.label != gj.label {
+				continue
+			}
+			if gi.end < 0 || gj.end < 0 || gi.end != gj.begin {
+				continue
+			}
+
+			buf := swapCandidate(s.rec.data, gi, gj)
+			if s.accept(buf, "swap adjacent groups %q at %v and %v", gi.label, i, i+1) {
+				restart = true
+				break
 			}
 		}
 	}
 }
 
+// swapCandidate returns a copy of data with the contents of the adjacent
+// groups gi and gj exchanged.
+func swapCandidate(data []uint64, gi, gj group) []uint64 {
+	buf := append([]uint64(nil), data...)
+	copy(buf[gi.begin:gi.begin+(gj.end-gj.begin)], data[gj.begin:gj.end])
+	copy(buf[gi.begin+(gj.end-gj.begin):gj.end], data[gi.begin:gi.end])
+	return buf
+}
+
 func (s *shrinker) minimizeBlocks() {
-	for i := 0; i < len(s.rec.data); i++ {
+	for i := 0; i < len(s.rec.data) && !s.budgetExceeded(); i++ {
 		minimize(s.rec.data[i], func(u uint64) bool {
 			buf := append([]uint64(nil), s.rec.data...)
 			buf[i] = u
@@ -120,27 +315,137 @@ func (s *shrinker) accept(buf []uint64, format string, args ...interface{}) bool
 		return false
 	}
 
-	s.tries++
-	s1 := newBufBitStream(buf, false)
-	t1 := newT(s.tb, s1, *debug)
-	t1.Logf("[shrink] trying to reproduce the failure with a smaller test case: "+format, args...)
-	err1 := checkOnce(t1, s.prop)
-	if traceback(err1) != traceback(s.err) {
+	return s.acceptBest([][]uint64{buf}, []string{fmt.Sprintf(format, args...)})
+}
+
+// reproduction is a candidate buffer that was confirmed to reproduce the
+// failure being shrunk.
+type reproduction struct {
+	buf  []uint64
+	err1 *panicError
+}
+
+// smallestReproduction returns the reproduction with the lexicographically
+// smallest buf under compareData, or nil if repros is empty.
+func smallestReproduction(repros []reproduction) *reproduction {
+	var best *reproduction
+	for i := range repros {
+		if best == nil || compareData(repros[i].buf, best.buf) < 0 {
+			best = &repros[i]
+		}
+	}
+	return best
+}
+
+// evaluateCandidates runs eval over candidates using up to workers
+// goroutines, stopping early once eval confirms a reproduction for one of
+// them, and returns the lexicographically smallest confirmed reproduction
+// under compareData, or nil if none reproduced. budgetExceeded is polled
+// before dispatching each remaining candidate, and ctx is canceled for the
+// eval calls still in flight as soon as the first reproduction is found.
+func evaluateCandidates(ctx context.Context, candidates [][]uint64, workers int, budgetExceeded func() bool, eval func(ctx context.Context, idx int, buf []uint64) (reproduction, bool)) *reproduction {
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(candidates) {
+		workers = len(candidates)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	found := make(chan reproduction, len(candidates))
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for idx := range jobs {
+				r, ok := eval(ctx, idx, candidates[idx])
+				if !ok {
+					continue
+				}
+
+				// found holds one slot per candidate, so this never blocks.
+				found <- r
+				cancel()
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i := range candidates {
+			if budgetExceeded() {
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	var repros []reproduction
+	for r := range found {
+		repros = append(repros, r)
+	}
+	return smallestReproduction(repros)
+}
+
+// acceptBest dispatches candidates to a pool of s.config.Parallelism
+// workers and adopts the smallest candidate confirmed to reproduce the
+// failure, canceling the rest once one is found.
+func (s *shrinker) acceptBest(candidates [][]uint64, labels []string) bool {
+	best := evaluateCandidates(s.ctx, candidates, s.config.Parallelism, s.budgetExceeded, func(ctx context.Context, idx int, buf []uint64) (reproduction, bool) {
+		if compareData(buf, s.rec.data) >= 0 {
+			return reproduction{}, false
+		}
+
+		s.mu.Lock()
+		if s.config.MaxTries > 0 && s.tries >= s.config.MaxTries {
+			s.mu.Unlock()
+			return reproduction{}, false
+		}
+		s.tries++
+		s.mu.Unlock()
+
+		s1 := newBufBitStream(buf, false)
+		t1 := newT(s.tb, s1, *debug)
+		t1.Logf("[shrink] trying to reproduce the failure with a smaller test case: %s", labels[idx])
+		err1 := checkOnce(t1, s.prop)
+		if traceback(err1) != traceback(s.err) {
+			return reproduction{}, false
+		}
+
+		return reproduction{buf: buf, err1: err1}, true
+	})
+
+	if best == nil {
 		return false
 	}
 
-	s.err = err1
-	s2 := newBufBitStream(buf, true)
+	s.err = best.err1
+	s2 := newBufBitStream(best.buf, true)
 	t2 := newT(s.tb, s2, *debug)
 	t2.Logf("[shrink] trying to reproduce the failure")
 	err2 := checkOnce(t2, s.prop)
 	s.rec = s2.recordedBits
 	s.rec.prune()
-	assert(compareData(s.rec.data, buf) <= 0)
+	assert(compareData(s.rec.data, best.buf) <= 0)
 	if *debugvis {
 		s.visBits = append(s.visBits, s.rec)
 	}
-	if !sameError(err1, err2) {
+	if !sameError(best.err1, err2) {
 		panic(err2)
 	}
 
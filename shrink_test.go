@@ -0,0 +1,251 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package rapid
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompareData(t *testing.T) {
+	cases := []struct {
+		a, b []uint64
+		want int
+	}{
+		{nil, nil, 0},
+		{[]uint64{1}, nil, 1},
+		{nil, []uint64{1}, -1},
+		{[]uint64{1, 2}, []uint64{1, 2}, 0},
+		{[]uint64{1, 2}, []uint64{1, 3}, -1},
+		{[]uint64{1, 3}, []uint64{1, 2}, 1},
+	}
+
+	for _, c := range cases {
+		if got := compareData(c.a, c.b); got != c.want {
+			t.Errorf("compareData(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestShrinkConfigDefaultParallelism(t *testing.T) {
+	config := ShrinkConfig{}.withDefaults()
+	if config.Parallelism != 1 {
+		t.Fatalf("ShrinkConfig{}.withDefaults().Parallelism = %v, want 1 (prop must not run concurrently unless opted into)", config.Parallelism)
+	}
+
+	config = ShrinkConfig{Parallelism: 4}.withDefaults()
+	if config.Parallelism != 4 {
+		t.Fatalf("ShrinkConfig{Parallelism: 4}.withDefaults().Parallelism = %v, want 4", config.Parallelism)
+	}
+}
+
+func TestBudgetExceeded(t *testing.T) {
+	s := &shrinker{start: time.Now()}
+	if s.budgetExceeded() {
+		t.Fatalf("budgetExceeded() with zero config, want false")
+	}
+
+	s = &shrinker{start: time.Now().Add(-time.Minute), config: ShrinkConfig{Deadline: time.Second}}
+	if !s.budgetExceeded() {
+		t.Fatalf("budgetExceeded() with expired deadline, want true")
+	}
+
+	s = &shrinker{start: time.Now(), config: ShrinkConfig{MaxTries: 3}, tries: 3}
+	if !s.budgetExceeded() {
+		t.Fatalf("budgetExceeded() with tries == MaxTries, want true")
+	}
+
+	s = &shrinker{start: time.Now(), config: ShrinkConfig{MaxTries: 3}, tries: 2}
+	if s.budgetExceeded() {
+		t.Fatalf("budgetExceeded() with tries < MaxTries, want false")
+	}
+}
+
+func TestRoundDidNotImprove(t *testing.T) {
+	s := &shrinker{}
+	if !s.roundDidNotImprove() {
+		t.Fatalf("roundDidNotImprove() on first stalled round with default MaxStallRounds, want true")
+	}
+
+	s = &shrinker{config: ShrinkConfig{MaxStallRounds: 3}}
+	for i := 0; i < 2; i++ {
+		if s.roundDidNotImprove() {
+			t.Fatalf("roundDidNotImprove() on stalled round %v with MaxStallRounds 3, want false", i+1)
+		}
+	}
+	if !s.roundDidNotImprove() {
+		t.Fatalf("roundDidNotImprove() on third stalled round with MaxStallRounds 3, want true")
+	}
+}
+
+func TestReportStep(t *testing.T) {
+	var gotBefore, gotAfter []uint64
+	var gotTries int
+
+	s := &shrinker{
+		rec: recordedBits{data: []uint64{1, 2}},
+		config: ShrinkConfig{
+			OnShrinkStep: func(before, after []uint64, tries int) {
+				gotBefore, gotAfter, gotTries = before, after, tries
+			},
+		},
+		tries: 5,
+	}
+
+	before := []uint64{1, 2, 3}
+	s.reportStep(before)
+
+	if compareData(gotBefore, before) != 0 || compareData(gotAfter, s.rec.data) != 0 || gotTries != 5 {
+		t.Fatalf("reportStep called OnShrinkStep with (%v, %v, %v), want (%v, %v, %v)",
+			gotBefore, gotAfter, gotTries, before, s.rec.data, 5)
+	}
+}
+
+func TestSmallestReproduction(t *testing.T) {
+	if got := smallestReproduction(nil); got != nil {
+		t.Fatalf("smallestReproduction(nil) = %v, want nil", got)
+	}
+
+	repros := []reproduction{
+		{buf: []uint64{1, 2}},
+		{buf: []uint64{1, 1}},
+		{buf: []uint64{0}},
+	}
+	got := smallestReproduction(repros)
+	if got == nil || compareData(got.buf, []uint64{0}) != 0 {
+		t.Fatalf("smallestReproduction(%v) = %v, want buf [0]", repros, got)
+	}
+}
+
+func TestCollapseCandidate(t *testing.T) {
+	data := []uint64{1, 2, 3, 4}
+	src := group{begin: 0, end: 2}
+	dst := group{begin: 2, end: 4}
+
+	got := collapseCandidate(data, src, dst)
+	want := []uint64{1, 2, 1, 2}
+	if compareData(got, want) != 0 {
+		t.Fatalf("collapseCandidate(%v, %v, %v) = %v, want %v", data, src, dst, got, want)
+	}
+	if compareData(data, []uint64{1, 2, 3, 4}) != 0 {
+		t.Fatalf("collapseCandidate mutated its input: %v", data)
+	}
+}
+
+func TestSwapCandidate(t *testing.T) {
+	data := []uint64{1, 2, 3}
+	gi := group{begin: 0, end: 1}
+	gj := group{begin: 1, end: 3}
+
+	got := swapCandidate(data, gi, gj)
+	want := []uint64{2, 3, 1}
+	if compareData(got, want) != 0 {
+		t.Fatalf("swapCandidate(%v, %v, %v) = %v, want %v", data, gi, gj, got, want)
+	}
+	if compareData(data, []uint64{1, 2, 3}) != 0 {
+		t.Fatalf("swapCandidate mutated its input: %v", data)
+	}
+}
+
+func TestEvaluateCandidatesPicksSmallestReproduction(t *testing.T) {
+	candidates := [][]uint64{{3}, {1}, {2}}
+	// Hold every eval until all three have started, so no candidate is
+	// left undispatched by the cancellation that follows the first winner.
+	var started sync.WaitGroup
+	started.Add(len(candidates))
+	eval := func(ctx context.Context, idx int, buf []uint64) (reproduction, bool) {
+		started.Done()
+		started.Wait()
+		return reproduction{buf: buf}, true
+	}
+
+	best := evaluateCandidates(context.Background(), candidates, 3, func() bool { return false }, eval)
+	if best == nil || compareData(best.buf, []uint64{1}) != 0 {
+		t.Fatalf("evaluateCandidates(...) = %v, want buf [1]", best)
+	}
+}
+
+func TestEvaluateCandidatesSkipsNonReproducing(t *testing.T) {
+	candidates := [][]uint64{{1}, {2}, {3}}
+	eval := func(ctx context.Context, idx int, buf []uint64) (reproduction, bool) {
+		return reproduction{buf: buf}, idx == 1
+	}
+
+	best := evaluateCandidates(context.Background(), candidates, 2, func() bool { return false }, eval)
+	if best == nil || compareData(best.buf, []uint64{2}) != 0 {
+		t.Fatalf("evaluateCandidates(...) = %v, want buf [2]", best)
+	}
+}
+
+func TestEvaluateCandidatesNoneReproduce(t *testing.T) {
+	candidates := [][]uint64{{1}, {2}}
+	eval := func(ctx context.Context, idx int, buf []uint64) (reproduction, bool) {
+		return reproduction{}, false
+	}
+
+	if best := evaluateCandidates(context.Background(), candidates, 2, func() bool { return false }, eval); best != nil {
+		t.Fatalf("evaluateCandidates(...) = %v, want nil", best)
+	}
+}
+
+// TestEvaluateCandidatesCancelsSiblingsOnFirstWinner exercises the
+// Parallelism > 1 path with workers racing against each other: the
+// candidate at index 0 reproduces immediately, and every other worker
+// blocks on ctx until canceled, verifying eval calls still in flight are
+// actually canceled rather than left to run to completion.
+func TestEvaluateCandidatesCancelsSiblingsOnFirstWinner(t *testing.T) {
+	candidates := make([][]uint64, 8)
+	for i := range candidates {
+		candidates[i] = []uint64{uint64(i)}
+	}
+
+	var canceled int32
+	// The winner waits for a sibling to be in flight before returning.
+	siblingStarted := make(chan struct{})
+	var once sync.Once
+	eval := func(ctx context.Context, idx int, buf []uint64) (reproduction, bool) {
+		if idx == 0 {
+			<-siblingStarted
+			return reproduction{buf: buf}, true
+		}
+		once.Do(func() { close(siblingStarted) })
+		<-ctx.Done()
+		atomic.AddInt32(&canceled, 1)
+		return reproduction{}, false
+	}
+
+	best := evaluateCandidates(context.Background(), candidates, 4, func() bool { return false }, eval)
+	if best == nil || compareData(best.buf, []uint64{0}) != 0 {
+		t.Fatalf("evaluateCandidates(...) = %v, want buf [0]", best)
+	}
+	if atomic.LoadInt32(&canceled) == 0 {
+		t.Fatalf("no sibling eval observed ctx cancellation after the first winner was found")
+	}
+}
+
+func TestEvaluateCandidatesBudgetExceededStopsDispatch(t *testing.T) {
+	candidates := [][]uint64{{1}, {2}, {3}}
+	var evaluated int32
+	eval := func(ctx context.Context, idx int, buf []uint64) (reproduction, bool) {
+		atomic.AddInt32(&evaluated, 1)
+		return reproduction{}, false
+	}
+
+	budgetExceeded := func() bool { return true }
+	if best := evaluateCandidates(context.Background(), candidates, 2, budgetExceeded, eval); best != nil {
+		t.Fatalf("evaluateCandidates(...) = %v, want nil", best)
+	}
+	if atomic.LoadInt32(&evaluated) != 0 {
+		t.Fatalf("evaluateCandidates dispatched %v candidates with budget already exceeded, want 0", evaluated)
+	}
+}
+
+func TestReportStepNoop(t *testing.T) {
+	s := &shrinker{rec: recordedBits{data: []uint64{1}}}
+	s.reportStep([]uint64{1}) // must not panic with OnShrinkStep unset
+}